@@ -0,0 +1,323 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CachingReadLease wraps a ReadLease, caching page-sized ranges of its
+// contents in memory so that reads hitting a cached page return without
+// touching the backing file. It implements ReadLease itself, so it's a
+// drop-in replacement wherever a plain read lease is used.
+//
+// The cache has no notion of the GCS object generation the underlying
+// file was populated from; callers that need to invalidate on generation
+// change (gcsx, not this package) should simply construct a new
+// CachingReadLease rather than reuse one across generations.
+//
+// All methods are safe for concurrent access.
+type CachingReadLease interface {
+	ReadLease
+}
+
+type cachingReadLease struct {
+	mu sync.Mutex
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	pageSize      int64
+	maxCacheBytes int64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// The wrapped lease, set to nil once revoked or upgraded.
+	//
+	// GUARDED_BY(mu)
+	inner ReadLease
+
+	// The size of inner as of construction; fixed, since leases aren't
+	// written to.
+	//
+	// GUARDED_BY(mu)
+	size int64
+
+	// The current offset, as with io.Seeker.
+	//
+	// GUARDED_BY(mu)
+	off int64
+
+	// Cached pages, keyed by page index (byte offset / pageSize). Counts
+	// against its own budget, maxCacheBytes, separate from the disk-backed
+	// lease bytes that fileLeaser tracks.
+	//
+	// GUARDED_BY(mu)
+	pages map[int64][]byte
+
+	// GUARDED_BY(mu)
+	cacheBytes int64
+}
+
+var _ CachingReadLease = &cachingReadLease{}
+
+func newCachingReadLease(
+	inner ReadLease,
+	pageSize int64,
+	maxCacheBytes int64) (crl *cachingReadLease) {
+	crl = &cachingReadLease{
+		pageSize:      pageSize,
+		maxCacheBytes: maxCacheBytes,
+		inner:         inner,
+		size:          inner.Size(),
+		pages:         make(map[int64][]byte),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (crl *cachingReadLease) Read(p []byte) (n int, err error) {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	n, err = crl.readAt(p, crl.off)
+	crl.off += int64(n)
+
+	return
+}
+
+func (crl *cachingReadLease) Seek(
+	offset int64,
+	whence int) (off int64, err error) {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	if crl.inner == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = crl.off + offset
+	case io.SeekEnd:
+		off = crl.size + offset
+	default:
+		err = fmt.Errorf("unknown whence: %d", whence)
+		return
+	}
+
+	crl.off = off
+	return
+}
+
+func (crl *cachingReadLease) ReadAt(p []byte, off int64) (n int, err error) {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	n, err = crl.readAt(p, off)
+	return
+}
+
+func (crl *cachingReadLease) Size() (size int64) {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	size = crl.size
+	return
+}
+
+func (crl *cachingReadLease) Revoked() (revoked bool) {
+	crl.mu.Lock()
+	defer crl.mu.Unlock()
+
+	revoked = crl.inner == nil || crl.inner.Revoked()
+	return
+}
+
+func (crl *cachingReadLease) Upgrade() (rwl ReadWriteLease, err error) {
+	crl.mu.Lock()
+	inner := crl.inner
+	crl.mu.Unlock()
+
+	if inner == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	rwl, err = inner.Upgrade()
+	if err != nil {
+		return
+	}
+
+	// Drain and invalidate the cache before handing rwl back, so that a
+	// reader can't observe a page we cached before the writer starts
+	// changing the file out from under it. After this, as with a plain
+	// read lease, it's as if we've been revoked.
+	crl.mu.Lock()
+	crl.inner = nil
+	crl.pages = nil
+	crl.cacheBytes = 0
+	crl.mu.Unlock()
+
+	return
+}
+
+func (crl *cachingReadLease) Revoke() {
+	crl.mu.Lock()
+	inner := crl.inner
+	crl.inner = nil
+	crl.pages = nil
+	crl.cacheBytes = 0
+	crl.mu.Unlock()
+
+	if inner != nil {
+		inner.Revoke()
+	}
+}
+
+func (crl *cachingReadLease) Pin(reason string) (err error) {
+	crl.mu.Lock()
+	inner := crl.inner
+	crl.mu.Unlock()
+
+	if inner == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	err = inner.Pin(reason)
+	return
+}
+
+func (crl *cachingReadLease) Unpin() {
+	crl.mu.Lock()
+	inner := crl.inner
+	crl.mu.Unlock()
+
+	if inner != nil {
+		inner.Unpin()
+	}
+}
+
+func (crl *cachingReadLease) WaitExclusive(ctx context.Context) (err error) {
+	crl.mu.Lock()
+	inner := crl.inner
+	crl.mu.Unlock()
+
+	if inner == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	err = inner.WaitExclusive(ctx)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// readAt implements ReadAt, and backs Read, under a single acquisition of
+// crl.mu so that concurrent callers can't race on crl.off the way they
+// would if Read read the offset, called ReadAt, and updated the offset
+// as three separate critical sections.
+//
+// LOCKS_REQUIRED(crl.mu)
+func (crl *cachingReadLease) readAt(p []byte, off int64) (n int, err error) {
+	if crl.inner == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	for n < len(p) {
+		idx := (off + int64(n)) / crl.pageSize
+		pageOff := (off + int64(n)) % crl.pageSize
+
+		var page []byte
+		page, err = crl.readPage(idx)
+		if err != nil {
+			return
+		}
+
+		if pageOff >= int64(len(page)) {
+			err = io.EOF
+			return
+		}
+
+		n += copy(p[n:], page[pageOff:])
+
+		if int64(len(page)) < crl.pageSize {
+			// A short page means we've hit the end of the file.
+			if n < len(p) {
+				err = io.EOF
+			}
+			return
+		}
+	}
+
+	return
+}
+
+// readPage returns the contents of the page at the given index, reading
+// through to crl.inner and caching the result if there's room, unless
+// it's already cached. A short slice (less than crl.pageSize) indicates
+// the page runs up to the end of the file.
+//
+// Cached pages are only as good as crl.inner's validity: if the leaser
+// revoked inner out from under us in the background (as opposed to an
+// explicit Revoke/Upgrade, which already clear crl.pages), a page cached
+// before that point would otherwise be served stale rather than
+// surfacing RevokedError like an uncached read would.
+//
+// LOCKS_REQUIRED(crl.mu)
+func (crl *cachingReadLease) readPage(idx int64) (page []byte, err error) {
+	if crl.inner.Revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	if cached, ok := crl.pages[idx]; ok {
+		page = cached
+		return
+	}
+
+	buf := make([]byte, crl.pageSize)
+	n, rerr := crl.inner.ReadAt(buf, idx*crl.pageSize)
+	if rerr != nil && rerr != io.EOF {
+		err = rerr
+		return
+	}
+	page = buf[:n]
+
+	if int64(len(page)) <= crl.maxCacheBytes-crl.cacheBytes {
+		crl.pages[idx] = page
+		crl.cacheBytes += int64(len(page))
+	}
+
+	return
+}
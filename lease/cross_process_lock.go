@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file coordinates leases across processes, not just within one, so
+// that two gcsfuse mounts (or a mount and an admin tool) sharing a cache
+// directory don't clobber each other's leases on the same backing file.
+// The approach mirrors cmd/go/internal/lockedfile: rather than locking the
+// data file itself (which would interfere with our own reads and writes
+// of it), we take an advisory lock on a sidecar "<name>.lock" file, shared
+// for the lifetime of a read lease and exclusive for the lifetime of a
+// read/write lease. The platform-specific half of the locking lives in
+// cross_process_lock_unix.go, cross_process_lock_windows.go and
+// cross_process_lock_plan9.go.
+package lease
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often WaitExclusive polls for the sidecar lock to become available.
+// Advisory file locks have no native way to block on a context, so we
+// fall back to polling a non-blocking attempt.
+const waitExclusivePollInterval = 10 * time.Millisecond
+
+func lockPath(name string) string {
+	return name + ".lock"
+}
+
+// acquireLock opens (creating if necessary) the sidecar lock file for
+// name and takes a blocking advisory lock on it, shared or exclusive.
+func acquireLock(name string, exclusive bool) (lf *os.File, err error) {
+	lf, err = os.OpenFile(lockPath(name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		err = fmt.Errorf("OpenFile(%q): %w", lockPath(name), err)
+		return
+	}
+
+	if err = lockFile(lf, exclusive); err != nil {
+		lf.Close()
+		lf = nil
+		err = fmt.Errorf("lockFile(%q): %w", lockPath(name), err)
+		return
+	}
+
+	return
+}
+
+// waitExclusive blocks, honoring ctx, until no open file description
+// other than lf's own holds a lock on lf's file, then restores lf's
+// prior (shared) lock before returning.
+//
+// It does this by repeatedly attempting to upgrade lf's own lock to
+// exclusive, rather than by opening a separate waiter fd: flock locks are
+// scoped to the open file description, not the path, so a lock attempt
+// through a newly opened fd would conflict with lf's own shared hold and
+// could never succeed while the caller keeps it. Upgrading lf in place
+// has no such self-conflict, since a description's own lock never blocks
+// a further lock request made through that same description.
+//
+// REQUIRES: lf currently holds a shared lock.
+func waitExclusive(ctx context.Context, lf *os.File) (err error) {
+	for {
+		ok, lerr := tryLockFile(lf, true)
+		if lerr != nil {
+			err = fmt.Errorf("tryLockFile(%q): %w", lf.Name(), lerr)
+			return
+		}
+
+		if ok {
+			// Restore the shared lock the caller is relying on before
+			// handing control back to it. A transient failure here (e.g.
+			// EINTR) would otherwise leave lf exclusively locked, blocking
+			// every other process's shared acquisition for as long as the
+			// caller keeps lf open, so retry rather than give up on the
+			// first error.
+			for {
+				lerr := lockFile(lf, false)
+				if lerr == nil {
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					err = fmt.Errorf("restoring shared lock on %q after ctx done: %w", lf.Name(), lerr)
+					return
+				default:
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-time.After(waitExclusivePollInterval):
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build plan9
+
+package lease
+
+import "os"
+
+// Plan 9 has no advisory locking equivalent to flock/LockFileEx, so
+// cross-process lease coordination can't be enforced there. As with
+// cmd/go/internal/lockedfile on plan9, we degrade to treating every lock
+// as immediately and always available rather than failing outright.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func tryLockFile(f *os.File, exclusive bool) (ok bool, err error) {
+	ok = true
+	return
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
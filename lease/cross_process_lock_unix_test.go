@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package lease
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// helperProcessEnv, when set in a child's environment, tells TestMain that
+// this invocation of the test binary should behave as the lock-holding
+// helper process rather than running the test suite. This is the same
+// re-exec-self trick used by net/http and os/exec's own tests to get a
+// second, genuinely separate process without a separate build target.
+const helperProcessEnv = "GCSFUSE_LEASE_LOCK_HELPER_PROCESS"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperProcessEnv) != "" {
+		runLockHelperProcess()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// runLockHelperProcess takes an exclusive cross-process lock on the path
+// given as os.Args[1], prints "ACQUIRED" to announce it, then blocks until
+// a line arrives on stdin before unlocking and closing the lock file and
+// returning.
+func runLockHelperProcess() {
+	lf, err := acquireLock(os.Args[1], true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "acquireLock: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("ACQUIRED")
+
+	bufio.NewReader(os.Stdin).ReadString('\n')
+
+	unlockFile(lf)
+	lf.Close()
+}
+
+// TestCrossProcessLockExcludesOtherProcess spawns a second copy of this
+// test binary that takes an exclusive lock on a shared path (see
+// cross_process_lock.go), and verifies that this process can't acquire
+// its own lock on the same path until the helper releases it. This is the
+// scenario acquireLock/cross_process_lock.go exist for: two gcsfuse
+// mounts (or a mount and an admin tool) sharing a cache directory must not
+// be able to hold conflicting locks on the same backing file at once.
+func TestCrossProcessLockExcludesOtherProcess(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/data"
+
+	cmd := exec.Command(os.Args[0], path)
+	cmd.Env = append(os.Environ(), helperProcessEnv+"=1")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer cmd.Wait()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading helper announcement: %v", err)
+	}
+	if line != "ACQUIRED\n" {
+		t.Fatalf("unexpected helper announcement: %q", line)
+	}
+
+	// The helper now holds an exclusive lock on path. We shouldn't be able
+	// to get our own lock on it promptly.
+	acquired := make(chan *os.File, 1)
+	go func() {
+		lf, err := acquireLock(path, true)
+		if err != nil {
+			t.Errorf("acquireLock: %v", err)
+			return
+		}
+		acquired <- lf
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired the lock while the helper process still holds it")
+	case <-time.After(200 * time.Millisecond):
+		// Expected: still blocked.
+	}
+
+	// Let the helper release and exit.
+	fmt.Fprintln(stdin, "release")
+	stdin.Close()
+
+	select {
+	case lf := <-acquired:
+		unlockFile(lf)
+		lf.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting to acquire the lock after the helper released it")
+	}
+}
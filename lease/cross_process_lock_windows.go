@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package lease
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockRangeBytes is large enough to cover any file we lease; LockFileEx
+// locks a byte range rather than the whole file.
+const lockRangeBytes = ^uint32(0)
+
+func lockFile(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	ol := new(windows.Overlapped)
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()), flags, 0, lockRangeBytes, 0, ol)
+}
+
+func tryLockFile(f *os.File, exclusive bool) (ok bool, err error) {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	ol := new(windows.Overlapped)
+	err = windows.LockFileEx(
+		windows.Handle(f.Fd()), flags, 0, lockRangeBytes, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		err = nil
+		return
+	}
+
+	ok = err == nil
+	return
+}
+
+func unlockFile(f *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(
+		windows.Handle(f.Fd()), 0, lockRangeBytes, 0, ol)
+}
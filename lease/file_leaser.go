@@ -0,0 +1,533 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileLeaser issues read/write leases on temporary files, and transparently
+// evicts the least recently used read leases in the background when a
+// soft capacity limit is exceeded.
+//
+// All methods are safe for concurrent access.
+type FileLeaser interface {
+	// Create a new temporary file, and return a read/write lease for it.
+	// The initial size of the file is zero.
+	NewFile() (rwl ReadWriteLease, err error)
+
+	// Return diagnostic info about every currently pinned read lease (see
+	// ReadLease.Pin), so operators can see why capacity is tied up when
+	// evictions start failing.
+	ListPinned() (infos []PinnedLeaseInfo)
+
+	// Create a new, empty read lease of the given size wrapped in a
+	// page-caching layer (see CachingReadLease), so that repeated reads of
+	// the same ranges don't keep hitting the backing file.
+	NewCachingReadLease(
+		size int64,
+		pageSize int64,
+		maxCacheBytes int64) (rl CachingReadLease, err error)
+}
+
+// Diagnostic info about a single pinned read lease, as returned by
+// FileLeaser.ListPinned.
+type PinnedLeaseInfo struct {
+	Size    int64
+	PinTime time.Time
+	Reason  string
+}
+
+// The maximum length of a Pin reason string; longer ones are truncated.
+const maxPinReasonLen = 240
+
+// The maximum number of least recently used read leases considered for
+// eviction in a single pass of the background worker. Keeping this small
+// bounds how long the leaser lock is held at a time; the worker simply
+// makes another pass if more capacity still needs to be reclaimed.
+const evictionBatchSize = 128
+
+// The maximum number of LRU entries a single snapshotEvictionBatch call
+// will examine, including ones skipped because they're pinned. Without
+// this, a long run of pinned entries at the LRU tail makes the scan for
+// evictionBatchSize real candidates unbounded, reintroducing the
+// long-lock-hold problem evictionBatchSize itself exists to avoid.
+const evictionScanLimit = 8 * evictionBatchSize
+
+// NewFileLeaser creates a file leaser that stores temporary files in dir
+// (or the system default temporary directory, if dir is empty) and tries
+// to keep the total size of outstanding read leases at or below
+// limitBytes, evicting the least recently used read leases in the
+// background whenever that soft limit is exceeded. Pinned read leases
+// (see ReadLease.Pin) are exempted from eviction but are capped
+// separately at pinnedLimitBytes.
+func NewFileLeaser(
+	dir string,
+	limitBytes int64,
+	pinnedLimitBytes int64) (fl FileLeaser) {
+	fl = newFileLeaser(dir, limitBytes, pinnedLimitBytes)
+	return
+}
+
+type fileLeaser struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	dir              string
+	limitBytes       int64
+	pinnedLimitBytes int64
+
+	// Wakes the background worker to look for eviction candidates. Buffered
+	// so that signalling it is never blocking; a pending signal may be
+	// coalesced with one already in the channel.
+	evictCh chan struct{}
+
+	// Promotions queued by promoteToMostRecent, for the background worker
+	// to apply. Buffered generously so that promoteToMostRecent is in
+	// practice a non-blocking, O(1) operation rather than one that takes
+	// fl.mu itself.
+	promoteCh chan *readLease
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// All outstanding (not yet revoked) read leases, ordered by recency of
+	// use. The front of the list is the most recently used.
+	//
+	// GUARDED_BY(mu)
+	readLeases list.List
+
+	// The sum of the sizes of the leases in readLeases.
+	//
+	// GUARDED_BY(mu)
+	readOutstanding int64
+
+	// The sum of the sizes of the currently pinned read leases, tracked
+	// against pinnedLimitBytes separately from readOutstanding.
+	//
+	// GUARDED_BY(mu)
+	pinnedOutstanding int64
+}
+
+func newFileLeaser(
+	dir string,
+	limitBytes int64,
+	pinnedLimitBytes int64) (fl *fileLeaser) {
+	fl = &fileLeaser{
+		dir:              dir,
+		limitBytes:       limitBytes,
+		pinnedLimitBytes: pinnedLimitBytes,
+		evictCh:          make(chan struct{}, 1),
+		promoteCh:        make(chan *readLease, 16*evictionBatchSize),
+	}
+
+	fl.readLeases.Init()
+	go fl.evictionWorker()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (fl *fileLeaser) NewFile() (rwl ReadWriteLease, err error) {
+	f, err := ioutil.TempFile(fl.dir, "gcsfuse-lease")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %w", err)
+		return
+	}
+
+	// Take an exclusive cross-process lock on the file for as long as we
+	// hold a read/write lease on it, so that another process opening the
+	// same path (e.g. a second gcsfuse mount sharing this cache directory)
+	// can't clobber it concurrently.
+	lf, err := acquireLock(f.Name(), true)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("acquireLock: %w", err)
+		return
+	}
+
+	rwl = newReadWriteLease(fl, 0, f, lf)
+	return
+}
+
+func (fl *fileLeaser) NewCachingReadLease(
+	size int64,
+	pageSize int64,
+	maxCacheBytes int64) (rl CachingReadLease, err error) {
+	f, err := ioutil.TempFile(fl.dir, "gcsfuse-lease")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %w", err)
+		return
+	}
+
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		err = fmt.Errorf("Truncate: %w", err)
+		return
+	}
+
+	lf, err := acquireLock(f.Name(), false)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("acquireLock: %w", err)
+		return
+	}
+
+	inner := fl.newReadLease(size, f, lf)
+	rl = newCachingReadLease(inner, pageSize, maxCacheBytes)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Lease bookkeeping, used by readLease and readWriteLease
+////////////////////////////////////////////////////////////////////////
+
+// newReadLease wraps the supplied file and its already-held cross-process
+// lock (held shared by the caller) in a read lease, and
+// registers it with the leaser, kicking off eviction in the background if
+// we're now over the soft limit.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) newReadLease(
+	size int64,
+	file *os.File,
+	lockFile *os.File) (rl *readLease) {
+	rl = newReadLease(size, fl, file, lockFile)
+
+	fl.mu.Lock()
+	rl.element = fl.readLeases.PushFront(rl)
+	fl.readOutstanding += size
+	over := fl.readOutstanding > fl.limitBytes
+	fl.mu.Unlock()
+
+	if over {
+		fl.signalEviction()
+	}
+
+	return
+}
+
+// promoteToMostRecent records that rl was just used. It does not itself
+// take fl.mu; the re-ordering is applied asynchronously by the background
+// worker, so that this is an O(1) operation even when the lease list is
+// large.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) promoteToMostRecent(rl *readLease) {
+	select {
+	case fl.promoteCh <- rl:
+	default:
+		// The worker is behind and the queue is full. Drop the promotion;
+		// rl simply keeps its current position until the next one gets
+		// through, which is harmless.
+	}
+}
+
+// upgrade implements readLease.Upgrade. It takes rl.Mu for the I/O-heavy
+// work of releasing rl's file, and only takes fl.mu afterwards, and
+// briefly, to unlink rl from the LRU. This way an upgrade of one lease
+// never blocks Read/ReadAt on unrelated leases.
+//
+// LOCKS_EXCLUDED(fl.mu)
+// LOCKS_EXCLUDED(rl.Mu)
+func (fl *fileLeaser) upgrade(rl *readLease) (rwl ReadWriteLease, err error) {
+	rl.Mu.Lock()
+	if rl.revoked() {
+		rl.Mu.Unlock()
+		err = &RevokedError{}
+		return
+	}
+
+	// Escalate the cross-process lock to exclusive before handing the file
+	// over as a read/write lease, so that no other process can still be
+	// holding it as a shared read lease while we write.
+	if lerr := lockFile(rl.lockFile, true); lerr != nil {
+		rl.Mu.Unlock()
+		err = fmt.Errorf("lockFile: %w", lerr)
+		return
+	}
+
+	f, lf := rl.release()
+	rl.Mu.Unlock()
+
+	fl.mu.Lock()
+	fl.unlinkLocked(rl)
+	fl.mu.Unlock()
+
+	rwl = newReadWriteLease(fl, rl.size, f, lf)
+	return
+}
+
+// revokeVoluntarily implements readLease.Revoke. As with upgrade, the
+// file close happens outside of fl.mu so that revoking one lease never
+// blocks unrelated lease I/O.
+//
+// LOCKS_EXCLUDED(fl.mu)
+// LOCKS_EXCLUDED(rl.Mu)
+func (fl *fileLeaser) revokeVoluntarily(rl *readLease) {
+	rl.Mu.Lock()
+	if rl.revoked() {
+		rl.Mu.Unlock()
+		return
+	}
+	f, lf := rl.release()
+	rl.Mu.Unlock()
+
+	fl.mu.Lock()
+	fl.unlinkLocked(rl)
+	fl.mu.Unlock()
+
+	unlockFile(lf)
+	lfName := lf.Name()
+	lf.Close()
+	os.Remove(lfName)
+
+	// Reclaim the backing file's disk space now that nothing holds it
+	// open anymore; otherwise revoking/evicting a read lease frees up
+	// readOutstanding bookkeeping without ever freeing the disk.
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+}
+
+// unlinkLocked removes rl from the LRU and accounting. rl must already be
+// revoked.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) unlinkLocked(rl *readLease) {
+	if rl.element != nil {
+		fl.readLeases.Remove(rl.element)
+		rl.element = nil
+	}
+
+	if rl.pinned {
+		rl.pinned = false
+		fl.pinnedOutstanding -= rl.size
+	}
+
+	fl.readOutstanding -= rl.size
+}
+
+// pin implements readLease.Pin.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) pin(rl *readLease, reason string) (err error) {
+	if len(reason) > maxPinReasonLen {
+		reason = reason[:maxPinReasonLen]
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// rl.element is nil'd out by unlinkLocked once a lease is revoked, so
+	// this (unlike rl.revoked()) can safely be checked under fl.mu alone.
+	if rl.element == nil {
+		err = &RevokedError{}
+		return
+	}
+
+	if !rl.pinned && fl.pinnedOutstanding+rl.size > fl.pinnedLimitBytes {
+		err = fmt.Errorf(
+			"pinning %d bytes would exceed the pinned lease budget of %d bytes",
+			rl.size, fl.pinnedLimitBytes)
+		return
+	}
+
+	if !rl.pinned {
+		fl.pinnedOutstanding += rl.size
+	}
+
+	rl.pinned = true
+	rl.pinReason = reason
+	rl.pinTime = time.Now()
+
+	return
+}
+
+// unpin implements readLease.Unpin.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) unpin(rl *readLease) {
+	fl.mu.Lock()
+	if !rl.pinned {
+		fl.mu.Unlock()
+		return
+	}
+
+	rl.pinned = false
+	fl.pinnedOutstanding -= rl.size
+	over := fl.readOutstanding > fl.limitBytes
+	fl.mu.Unlock()
+
+	// rl may be exactly the sort of lease eviction previously gave up on
+	// because the LRU tail was all pinned (see evictionScanLimit); wake
+	// the worker so it doesn't sit around over limitBytes until some
+	// unrelated newReadLease happens to also be over.
+	if over {
+		fl.signalEviction()
+	}
+}
+
+// ListPinned implements FileLeaser.ListPinned.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) ListPinned() (infos []PinnedLeaseInfo) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	for e := fl.readLeases.Front(); e != nil; e = e.Next() {
+		rl := e.Value.(*readLease)
+		if !rl.pinned {
+			continue
+		}
+
+		infos = append(infos, PinnedLeaseInfo{
+			Size:    rl.size,
+			PinTime: rl.pinTime,
+			Reason:  rl.pinReason,
+		})
+	}
+
+	return
+}
+
+func (fl *fileLeaser) signalEviction() {
+	select {
+	case fl.evictCh <- struct{}{}:
+	default:
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Background worker
+////////////////////////////////////////////////////////////////////////
+
+// evictionWorker drains queued promotions and, whenever signalled that the
+// soft limit may have been exceeded, evicts least recently used read
+// leases in small batches so that no single pass holds fl.mu for long.
+func (fl *fileLeaser) evictionWorker() {
+	for {
+		select {
+		case rl := <-fl.promoteCh:
+			fl.applyPromotion(rl)
+
+		case <-fl.evictCh:
+			fl.evictBatches()
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) applyPromotion(rl *readLease) {
+	fl.mu.Lock()
+	if rl.element != nil {
+		fl.readLeases.MoveToFront(rl.element)
+	}
+	fl.mu.Unlock()
+}
+
+// evictBatches repeatedly snapshots and evicts up to evictionBatchSize
+// candidates at a time, until we're back under the limit or there is
+// nothing left to evict.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) evictBatches() {
+	for {
+		batch, doneUnder := fl.snapshotEvictionBatch()
+		if len(batch) == 0 {
+			return
+		}
+
+		for _, rl := range batch {
+			fl.evictOne(rl)
+		}
+
+		if doneUnder {
+			return
+		}
+	}
+}
+
+// snapshotEvictionBatch takes fl.mu only long enough to copy out up to
+// evictionBatchSize of the least recently used leases. doneUnder reports
+// whether readOutstanding was already at or below limitBytes when the
+// snapshot was taken.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) snapshotEvictionBatch() (batch []*readLease, doneUnder bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	if fl.readOutstanding <= fl.limitBytes {
+		doneUnder = true
+		return
+	}
+
+	scanned := 0
+	for e := fl.readLeases.Back(); e != nil && len(batch) < evictionBatchSize && scanned < evictionScanLimit; e = e.Prev() {
+		scanned++
+		rl := e.Value.(*readLease)
+		if rl.pinned {
+			continue
+		}
+		batch = append(batch, rl)
+	}
+
+	return
+}
+
+// evictOne does the I/O-heavy work of releasing a single lease's backing
+// file without holding fl.mu, then takes fl.mu only briefly to unlink it
+// from the LRU and update accounting.
+//
+// LOCKS_EXCLUDED(fl.mu)
+// LOCKS_EXCLUDED(rl.Mu)
+func (fl *fileLeaser) evictOne(rl *readLease) {
+	rl.Mu.Lock()
+	if rl.revoked() {
+		rl.Mu.Unlock()
+		return
+	}
+	f, lf := rl.release()
+	rl.Mu.Unlock()
+
+	unlockFile(lf)
+	lfName := lf.Name()
+	lf.Close()
+	os.Remove(lfName)
+
+	// Reclaim the backing file's disk space now that nothing holds it
+	// open anymore; otherwise eviction reclaims file descriptors but not
+	// a single byte of disk.
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+
+	fl.mu.Lock()
+	fl.unlinkLocked(rl)
+	fl.mu.Unlock()
+}
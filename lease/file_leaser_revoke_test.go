@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentRevokeAndReadLatency stress-tests revoking half a
+// population of leases while readers concurrently hit the other half, and
+// asserts that the p99 reader latency stays under a fixed budget. The
+// readers' ReadAt calls take only their own leases' locks (promotions are
+// queued for the background worker rather than taking fl.mu), so the
+// revocations running alongside them have no lock to stall them on.
+func TestConcurrentRevokeAndReadLatency(t *testing.T) {
+	const population = 200
+	const readIterations = 50
+
+	dir := t.TempDir()
+	fl := newFileLeaser(dir, 1<<30, 0)
+
+	readers := make([]CachingReadLease, 0, population/2)
+	toRevoke := make([]CachingReadLease, 0, population/2)
+
+	for i := 0; i < population; i++ {
+		rl, err := fl.NewCachingReadLease(4096, 4096, 1<<20)
+		if err != nil {
+			t.Fatalf("NewCachingReadLease: %v", err)
+		}
+
+		if i%2 == 0 {
+			readers = append(readers, rl)
+		} else {
+			toRevoke = append(toRevoke, rl)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var latenciesMu sync.Mutex
+	var latencies []time.Duration
+
+	for _, rl := range toRevoke {
+		wg.Add(1)
+		go func(rl CachingReadLease) {
+			defer wg.Done()
+			rl.Revoke()
+		}(rl)
+	}
+
+	for _, rl := range readers {
+		wg.Add(1)
+		go func(rl CachingReadLease) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for i := 0; i < readIterations; i++ {
+				start := time.Now()
+				_, err := rl.ReadAt(buf, 0)
+				elapsed := time.Since(start)
+
+				if err != nil {
+					t.Errorf("ReadAt: %v", err)
+					return
+				}
+
+				latenciesMu.Lock()
+				latencies = append(latencies, elapsed)
+				latenciesMu.Unlock()
+			}
+		}(rl)
+	}
+
+	wg.Wait()
+
+	if len(latencies) == 0 {
+		t.Fatal("no reads completed")
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[(len(latencies)*99)/100]
+
+	// Generous bound: well above anything a healthy ReadAt of a single
+	// 4 KiB page should take.
+	const p99Budget = 250 * time.Millisecond
+	if p99 > p99Budget {
+		t.Errorf("p99 read latency %v exceeds budget %v", p99, p99Budget)
+	}
+}
@@ -15,9 +15,12 @@
 package lease
 
 import (
+	"container/list"
+	"context"
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 // A sentinel error used when a lease has been revoked.
@@ -53,6 +56,27 @@ type ReadLease interface {
 	// Cause the lease to be revoked and any associated resources to be cleaned
 	// up, if it has not already been revoked.
 	Revoke()
+
+	// Mark the lease as ineligible for capacity-pressure eviction, e.g.
+	// because revoking it would thrash (an mmap'd binary, a file being
+	// streamed to a slow client). Pinned leases still count toward a
+	// separate pinned-bytes budget; Pin returns an error rather than
+	// silently over-committing if that budget would be exceeded. reason is
+	// recorded for diagnostics (see fileLeaser.ListPinned) and truncated if
+	// it's unreasonably long.
+	Pin(reason string) (err error)
+
+	// Undo a previous Pin, making the lease eligible for eviction again. A
+	// no-op if the lease is not currently pinned.
+	Unpin()
+
+	// Block until no other process holds a shared (or exclusive) lease on
+	// the underlying file, via the advisory lock described in
+	// cross_process_lock.go, or until ctx is done. This lease's own hold is
+	// unaffected; it's for callers that need a quiescence point (e.g.
+	// before a risky maintenance operation) rather than for acquiring
+	// exclusivity themselves.
+	WaitExclusive(ctx context.Context) (err error)
 }
 
 type readLease struct {
@@ -76,6 +100,28 @@ type readLease struct {
 	//
 	// GUARDED_BY(Mu)
 	file *os.File
+
+	// A sidecar file used to hold a LOCK_SH advisory lock on file for as
+	// long as this lease is outstanding, coordinating with other processes
+	// that may have the same backing file open. Set to nil once revoked.
+	//
+	// GUARDED_BY(Mu)
+	lockFile *os.File
+
+	// This lease's element in fileLeaser.readLeases, or nil if the lease
+	// has been revoked and unlinked. Maintained by fileLeaser, which may
+	// read and write it while holding its own lock rather than rl.Mu.
+	//
+	// GUARDED_BY(leaser.mu)
+	element *list.Element
+
+	// Whether this lease is currently pinned against eviction, and
+	// diagnostics about why. Maintained by fileLeaser.pin/unpin.
+	//
+	// GUARDED_BY(leaser.mu)
+	pinned    bool
+	pinReason string
+	pinTime   time.Time
 }
 
 var _ ReadLease = &readLease{}
@@ -83,11 +129,13 @@ var _ ReadLease = &readLease{}
 func newReadLease(
 	size int64,
 	leaser *fileLeaser,
-	file *os.File) (rl *readLease) {
+	file *os.File,
+	lockFile *os.File) (rl *readLease) {
 	rl = &readLease{
-		size:   size,
-		leaser: leaser,
-		file:   file,
+		size:     size,
+		leaser:   leaser,
+		file:     file,
+		lockFile: lockFile,
 	}
 
 	return
@@ -178,6 +226,32 @@ func (rl *readLease) Revoke() {
 	rl.leaser.revokeVoluntarily(rl)
 }
 
+// LOCKS_EXCLUDED(rl.leaser.mu)
+func (rl *readLease) Pin(reason string) (err error) {
+	err = rl.leaser.pin(rl, reason)
+	return
+}
+
+// LOCKS_EXCLUDED(rl.leaser.mu)
+func (rl *readLease) Unpin() {
+	rl.leaser.unpin(rl)
+}
+
+// LOCKS_EXCLUDED(rl.Mu)
+func (rl *readLease) WaitExclusive(ctx context.Context) (err error) {
+	rl.Mu.Lock()
+	if rl.revoked() {
+		rl.Mu.Unlock()
+		err = &RevokedError{}
+		return
+	}
+	lf := rl.lockFile
+	rl.Mu.Unlock()
+
+	err = waitExclusive(ctx, lf)
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
@@ -189,18 +263,23 @@ func (rl *readLease) revoked() bool {
 	return rl.file == nil
 }
 
-// Relinquish control of the file, marking the lease as revoked.
+// Relinquish control of the file and its cross-process lock, marking the
+// lease as revoked. The caller takes on responsibility for unlocking and
+// closing lockFile, unless it hands both files on to a new lease (see
+// fileLeaser.upgrade).
 //
 // REQUIRES: Not yet revoked.
 //
 // LOCKS_REQUIRED(rl.Mu)
-func (rl *readLease) release() (file *os.File) {
+func (rl *readLease) release() (file *os.File, lockFile *os.File) {
 	if rl.revoked() {
 		panic("Already revoked")
 	}
 
 	file = rl.file
+	lockFile = rl.lockFile
 	rl.file = nil
+	rl.lockFile = nil
 
 	return
 }
@@ -0,0 +1,258 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A read/write lease for a temporary file, as returned by
+// FileLeaser.NewFile or ReadLease.Upgrade. Unlike read leases, read/write
+// leases are never revoked for capacity reasons; the caller is expected to
+// downgrade back to a read lease (or revoke outright) when finished
+// writing.
+//
+// All methods are safe for concurrent access.
+type ReadWriteLease interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+
+	// Return the current size of the underlying file.
+	Size() (size int64)
+
+	// Truncate the underlying file, as with os.File.Truncate.
+	Truncate(size int64) (err error)
+
+	// Downgrade to a read lease, making the underlying file eligible for
+	// eviction under capacity pressure like any other read lease. After
+	// downgrading, it is as if this lease has been revoked.
+	Downgrade() (rl ReadLease, err error)
+
+	// Cause the lease to be revoked and any associated resources to be
+	// cleaned up, if it has not already been revoked.
+	Revoke()
+}
+
+type readWriteLease struct {
+	mu sync.Mutex
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	leaser *fileLeaser
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// GUARDED_BY(mu)
+	size int64
+
+	// The underlying file, set to nil once revoked or downgraded.
+	//
+	// GUARDED_BY(mu)
+	file *os.File
+
+	// A sidecar file holding a cross-process LOCK_EX advisory lock on
+	// file, set to nil once revoked or downgraded.
+	//
+	// GUARDED_BY(mu)
+	lockFile *os.File
+}
+
+var _ ReadWriteLease = &readWriteLease{}
+
+func newReadWriteLease(
+	leaser *fileLeaser,
+	size int64,
+	file *os.File,
+	lockFile *os.File) (rwl *readWriteLease) {
+	rwl = &readWriteLease{
+		leaser:   leaser,
+		size:     size,
+		file:     file,
+		lockFile: lockFile,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (rwl *readWriteLease) Read(p []byte) (n int, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	n, err = rwl.file.Read(p)
+	return
+}
+
+func (rwl *readWriteLease) Write(p []byte) (n int, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	off, err := rwl.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	n, err = rwl.file.Write(p)
+	if end := off + int64(n); end > rwl.size {
+		rwl.size = end
+	}
+
+	return
+}
+
+func (rwl *readWriteLease) Seek(
+	offset int64,
+	whence int) (off int64, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	off, err = rwl.file.Seek(offset, whence)
+	return
+}
+
+func (rwl *readWriteLease) ReadAt(p []byte, off int64) (n int, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	n, err = rwl.file.ReadAt(p, off)
+	return
+}
+
+func (rwl *readWriteLease) WriteAt(p []byte, off int64) (n int, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	n, err = rwl.file.WriteAt(p, off)
+	if end := off + int64(n); end > rwl.size {
+		rwl.size = end
+	}
+
+	return
+}
+
+func (rwl *readWriteLease) Size() (size int64) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	size = rwl.size
+	return
+}
+
+func (rwl *readWriteLease) Truncate(size int64) (err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	err = rwl.file.Truncate(size)
+	if err == nil {
+		rwl.size = size
+	}
+
+	return
+}
+
+func (rwl *readWriteLease) Downgrade() (rl ReadLease, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	// Demote the cross-process lock to shared before handing the file off
+	// as a read lease.
+	if err = lockFile(rwl.lockFile, false); err != nil {
+		err = fmt.Errorf("lockFile: %w", err)
+		return
+	}
+
+	f := rwl.file
+	lf := rwl.lockFile
+	rwl.file = nil
+	rwl.lockFile = nil
+
+	rl = rwl.leaser.newReadLease(rwl.size, f, lf)
+	return
+}
+
+func (rwl *readWriteLease) Revoke() {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	if rwl.revoked() {
+		return
+	}
+
+	unlockFile(rwl.lockFile)
+	lockName := rwl.lockFile.Name()
+	rwl.lockFile.Close()
+	os.Remove(lockName)
+	rwl.lockFile = nil
+
+	name := rwl.file.Name()
+	rwl.file.Close()
+	os.Remove(name)
+	rwl.file = nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(rwl.mu)
+func (rwl *readWriteLease) revoked() bool {
+	return rwl.file == nil
+}